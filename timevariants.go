@@ -1,8 +1,9 @@
-// This program is a very basic harness for benchmarking the time it
-// takes to relink kubernetes 'kubelet'. It reads in a file
-// 'variants.txt' containing tag:goroot tuples, then for each goroot,
-// it performs a relink for N times (default of 20). Output is
-// intended to be used with benchcmp/benchstat. Example of a
+// This program is a general harness for benchmarking the time it
+// takes multiple Go toolchains to build or relink a real program. It
+// reads in a file 'variants.txt' containing
+// tag:goroot tuples (one per toolchain under comparison), then for
+// each goroot, it performs a relink for N times (default of 20).
+// Output is intended to be used with benchcmp/benchstat. Example of a
 // variants.txt file:
 //
 // $ cat variants.txt
@@ -15,37 +16,91 @@
 //
 //    tag:goroot:options:GOMAXPROCS
 //
-// where only the first items are required.
+// where only the first items are required. A line may also carry
+// trailing "key=value" tokens, separated from the positional fields
+// (and each other) by whitespace, to pin that variant to a specific
+// build target rather than running it against every target in
+// targets.txt:
 //
-// Output is of the form 'out.<tag>.txt', which is in a form suitable
-// for benchstat. Example (using variants.txt above):
+//    master:/ssd/go.master target=etcd
+//    master:/ssd/go.master path=k8s.io/kubernetes/cmd/kubelet prog=kubelet
+//
+// Recognized keys are "target" (a name looked up in targets.txt),
+// "path" (the import path to build), "prog" (the binary's base name,
+// used for temp output paths), "prebuild" (a shell command to run
+// before "go build"), "ldflags" (the -ldflags value to use for
+// the "-x" nodebug pass), and "name" (the label used in benchmark
+// tags and output filenames; when a variant pins an ad hoc "path="/
+// "prog=" target without an explicit "name=", one is derived from
+// "prog" or the last element of "path" instead of defaulting to
+// "Kubelet").
+//
+// If present, 'targets.txt' describes the set of programs to build,
+// one per line, as the same "key=value" tokens described above other
+// than "target" (at minimum "name" and "path"):
+//
+// $ cat targets.txt
+// name=kubelet path=k8s.io/kubernetes/cmd/kubelet
+// name=etcd path=go.etcd.io/etcd/server/v3
+// $
+//
+// A variant carrying any of the trailing tokens above is pinned to a
+// single target: the one named by "target=" (or the implicit kubelet
+// target if there is none), with its other tokens overriding that
+// target's fields. Every variant without such tokens is run against
+// every target in targets.txt (a
+// cartesian product); without a targets.txt file at all, a single
+// implicit "kubelet" target is used, matching this tool's original
+// behavior.
+//
+// Output is of the form 'out.<tag>.<target>.<hash>.txt', which is in
+// a form suitable for benchstat. Example (using variants.txt above,
+// with no targets.txt so the implicit kubelet target applies):
 //
 // $ go build timevariants.go
 // $ ./timevariants -x
 // ...
-// $ benchstat out.master.txt out.devlink.txt
+// $ benchstat out.master.kubelet.*.txt out.devlink.kubelet.*.txt
 // name                        old time/op  new time/op  delta
-// RelinkKubelet                14.5s ± 3%   14.3s ± 3%  -1.67%  (p=0.000 n=27+30)
-// RelinkKubelet-WithoutDebug   8.31s ± 6%   8.21s ± 3%  -1.20%  (p=0.004 n=30+29)
+// KubeletRelink                14.5s ± 3%   14.3s ± 3%  -1.67%  (p=0.000 n=27+30)
+// KubeletRelink-WithoutDebug   8.31s ± 6%   8.21s ± 3%  -1.20%  (p=0.004 n=30+29)
+//
+// Timing runs for the individual variant/target cells are farmed out
+// to a pool of worker goroutines (see the "-j" flag below), and the
+// set of runs can additionally be partitioned across several
+// invocations of this program (e.g. running on several machines at
+// once) using "-shard" and "-shards".
 //
+// Passing "-profile" wraps each timed "go build" in a -toolexec
+// script that asks cmd/compile and cmd/link for a mem/cpu profile,
+// writing them to "prof/<tag>.<target>/<kind>/<iter>/" (kind being
+// "timed" or "nodebug"); passing "-json-build"
+// additionally captures the "go build -json" event stream for that
+// build and uses it to emit auxiliary per-package/link benchstat
+// lines. Neither flag changes anything about the default fast path.
 
 package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 const sh = "/bin/sh"
-const prog = "kubelet"
-const progpath = "k8s.io/kubernetes/cmd/kubelet"
 
 var verbflag = flag.Bool("v", false, "Emit debug/trace output")
 var buildflag = flag.Bool("build", false, "Benchmark entire build, as opposed to relink")
@@ -54,6 +109,15 @@ var nodebugflag = flag.Bool("x", false, "Test '-s -w' relink as well.")
 var dryrunflag = flag.Bool("d", false, "Dry run -- show cmds but don't execute")
 var perflockflag = flag.Bool("P", false, "Run things under perflock.")
 var preservetmpsflag = flag.Bool("preservetmp", false, "Preserve tmp script files")
+var parflag = flag.Int("j", runtime.NumCPU(), "Number of timing runs to execute in parallel")
+var shardflag = flag.Int("shard", 0, "This invocation's shard index (0-based); used with -shards")
+var shardsflag = flag.Int("shards", 1, "Total number of shards the set of runs is partitioned into")
+var serializetimedflag = flag.Bool("serialize-timed", false, "Serialize the timed portion of each run (setup/clean may still overlap)")
+var ciflag = flag.Float64("ci", 0, "Adaptive sampling: keep sampling a variant until the relative 95% CI half-width on the mean is <= this (e.g. 0.02 for +/-2%); 0 disables adaptive sampling and uses a fixed -n iterations instead")
+var minnflag = flag.Int("min-n", 5, "Minimum number of samples to take before checking the -ci stopping criterion")
+var maxnflag = flag.Int("max-n", 100, "Maximum number of samples to take for a variant in adaptive (-ci) mode")
+var profileflag = flag.Bool("profile", false, "Collect per-iteration linker/compiler memprofile and cpuprofile via -toolexec")
+var jsonbuildflag = flag.Bool("json-build", false, "Capture 'go build -json' build-event output and attribute time to individual packages")
 
 func usage(msg string) {
 	if len(msg) > 0 {
@@ -64,14 +128,26 @@ func usage(msg string) {
 	os.Exit(2)
 }
 
-func runCmd(name string, cmd *exec.Cmd, outf *os.File) error {
+func titleCase(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// runCmd executes 'cmd', timing it, then writes a benchstat-compatible
+// line to 'outf' recording the elapsed time under 'name' and returns
+// that elapsed time. Access to 'outf' is serialized via 'writeMu',
+// since several workers may run jobs for the same cell and so share
+// its output file.
+func runCmd(name string, cmd *exec.Cmd, outf *os.File, writeMu *sync.Mutex) (int64, error) {
 	start := time.Now()
 	if *dryrunflag {
 		fmt.Fprintf(os.Stderr, "... executing timing run\n")
 	} else {
 		out, err := cmd.CombinedOutput()
 		if err != nil {
-			return fmt.Errorf("%v\n%s", err, out)
+			return 0, fmt.Errorf("%v\n%s", err, out)
 		}
 		if *verbflag {
 			fmt.Fprintf(os.Stderr, "... output: %s\n", string(out))
@@ -81,8 +157,121 @@ func runCmd(name string, cmd *exec.Cmd, outf *os.File) error {
 	if *verbflag {
 		fmt.Fprintf(os.Stderr, "... timing run took %d ns\n", took)
 	}
+	writeMu.Lock()
 	fmt.Fprintf(outf, "%s 1 %d ns/op\n", name, took)
-	return nil
+	writeMu.Unlock()
+	return took, nil
+}
+
+// target describes one build target: a program to build/relink,
+// identified by its import path, plus the knobs needed to do so.
+type target struct {
+	name     string
+	prog     string
+	path     string
+	prebuild string
+	ldflags  string
+}
+
+// defaultTarget is used for variants that don't pin themselves to a
+// target and when no targets.txt file is present, preserving this
+// tool's original kubelet-only behavior.
+var defaultTarget = &target{
+	name:    "Kubelet",
+	prog:    "kubelet",
+	path:    "k8s.io/kubernetes/cmd/kubelet",
+	ldflags: `-s -w`,
+}
+
+// targets holds every target parsed out of targets.txt, keyed by
+// name, and targetList holds the same set in file order (used to
+// build the variants x targets cartesian product).
+var targets = map[string]*target{}
+var targetList []*target
+
+// variantOverrideKeys is the set of recognized "key=value" keys a
+// variants.txt line's trailing tokens may use (see resolveVariantTarget
+// and readvariants' handling of the "options" field).
+var variantOverrideKeys = map[string]bool{
+	"target":   true,
+	"path":     true,
+	"prog":     true,
+	"prebuild": true,
+	"ldflags":  true,
+	"name":     true,
+}
+
+// parseKeyVals parses a sequence of whitespace-separated "key=value"
+// tokens into a map, used for both targets.txt lines and the trailing
+// tokens on a variants.txt line.
+func parseKeyVals(tokens []string) map[string]string {
+	kv := make(map[string]string, len(tokens))
+	for _, tok := range tokens {
+		parts := strings.SplitN(tok, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("malformed key=value token %q\n", tok)
+		}
+		kv[parts[0]] = parts[1]
+	}
+	return kv
+}
+
+// readtargets reads the optional 'targets.txt' file describing the
+// set of programs to build. If the file doesn't exist, 'targets' and
+// 'targetList' are left empty and callers fall back to
+// 'defaultTarget'.
+func readtargets() {
+	file, err := os.Open("targets.txt")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	lineNum := 1
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 || line[0] == '#' {
+			lineNum++
+			continue
+		}
+		kv := parseKeyVals(strings.Fields(line))
+		t := &target{ldflags: `-s -w`}
+		for k, v := range kv {
+			switch k {
+			case "name":
+				t.name = v
+			case "path":
+				t.path = v
+			case "prog":
+				t.prog = v
+			case "prebuild":
+				t.prebuild = v
+			case "ldflags":
+				t.ldflags = v
+			default:
+				log.Fatalf("targets.txt line %d: unrecognized key %q\n", lineNum, k)
+			}
+		}
+		if t.name == "" || t.path == "" {
+			log.Fatalf("targets.txt line %d: 'name' and 'path' are required\n", lineNum)
+		}
+		if t.prog == "" {
+			t.prog = strings.ToLower(t.name)
+		}
+		if _, ok := targets[t.name]; ok {
+			log.Fatalf("targets.txt line %d: target %q defined more than once\n", lineNum, t.name)
+		}
+		targets[t.name] = t
+		targetList = append(targetList, t)
+		lineNum++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 type variant struct {
@@ -90,10 +279,65 @@ type variant struct {
 	goroot string
 	extras string
 	gomaxp int
+	// tgt is non-nil when this variant's line pinned it to a
+	// specific target via any trailing key=value token; otherwise
+	// it is run against every target in targetList (or
+	// defaultTarget if targetList is empty).
+	tgt *target
 }
 
 var variants []variant
 
+// resolveVariantTarget builds the target override (if any) that a
+// variants.txt line's trailing key=value tokens describe.
+func resolveVariantTarget(kv map[string]string, tag string) *target {
+	if len(kv) == 0 {
+		return nil
+	}
+	var t target
+	if name, ok := kv["target"]; ok {
+		named, found := targets[name]
+		if !found {
+			log.Fatalf("variant %q refers to unknown target %q (not in targets.txt)\n", tag, name)
+		}
+		t = *named
+	} else {
+		t = *defaultTarget
+	}
+	if v, ok := kv["path"]; ok {
+		t.path = v
+	}
+	if v, ok := kv["prog"]; ok {
+		t.prog = v
+	}
+	if v, ok := kv["prebuild"]; ok {
+		t.prebuild = v
+	}
+	if v, ok := kv["ldflags"]; ok {
+		t.ldflags = v
+	}
+	if v, ok := kv["name"]; ok {
+		t.name = v
+	} else if _, named := kv["target"]; !named {
+		// An ad hoc path/prog override with no explicit "name=" and
+		// no "target=" lookup shouldn't keep defaultTarget's
+		// "Kubelet" label.
+		switch {
+		case kv["prog"] != "":
+			t.name = titleCase(kv["prog"])
+		case kv["path"] != "":
+			t.name = titleCase(path.Base(kv["path"]))
+		}
+	}
+	if t.path == "" {
+		log.Fatalf("variant %q: target override has no 'path'\n", tag)
+	}
+	if t.prog == "" {
+		t.prog = strings.ToLower(t.name)
+	}
+	return &t
+}
+
 func readvariants() {
 	file, err := os.Open("variants.txt")
 	if err != nil {
@@ -114,9 +358,32 @@ func readvariants() {
 			lineNum++
 			continue
 		}
+		// Trailing "key=value" tokens (see resolveVariantTarget) are
+		// whitespace-separated from the positional tag:goroot:options:
+		// GOMAXPROCS spec and from each other, but the positional
+		// spec's own "options" field may itself contain whitespace
+		// (e.g. "-tags foo"). So rather than splitting the whole
+		// line on whitespace up front (which would also split a
+		// multi-word options field and misparse its second half as a
+		// bogus key=value token), peel off only the trailing fields
+		// that actually look like "key=value" pairs for a recognized
+		// key, and treat everything before that as the positional
+		// spec.
+		fields := strings.Fields(line)
+		cut := len(fields)
+		for cut > 0 {
+			key, _, ok := strings.Cut(fields[cut-1], "=")
+			if !ok || key == "" || !variantOverrideKeys[key] {
+				break
+			}
+			cut--
+		}
+		kvFields := fields[cut:]
+		spec := strings.Join(fields[:cut], " ")
+
 		extras := ""
 		gomaxps := ""
-		tokens := strings.Split(line, ":")
+		tokens := strings.Split(spec, ":")
 		switch len(tokens) {
 		case 2:
 		case 3:
@@ -140,11 +407,13 @@ func readvariants() {
 					tag, gomaxp)
 			}
 		}
+		kv := parseKeyVals(kvFields)
 		v := variant{
 			tag:    tag,
 			goroot: goroot,
 			extras: extras,
 			gomaxp: gomaxp,
+			tgt:    resolveVariantTarget(kv, tag),
 		}
 		variants = append(variants, v)
 		if _, ok := tags[tag]; ok {
@@ -183,16 +452,51 @@ func readvariants() {
 
 }
 
+// cell is one unit of the variants x targets cartesian product: a
+// given toolchain variant building a given target.
+type cell struct {
+	v   variant
+	tgt *target
+}
+
+var cells []cell
+
+// buildCells expands 'variants' into the full set of (variant,
+// target) cells to benchmark: variants pinned to a target (via any
+// trailing key=value token in variants.txt) contribute a single cell, and
+// all others contribute one cell per entry in targetList (or
+// defaultTarget, if targetList is empty).
+func buildCells() []cell {
+	var cs []cell
+	for _, v := range variants {
+		if v.tgt != nil {
+			cs = append(cs, cell{v: v, tgt: v.tgt})
+			continue
+		}
+		if len(targetList) == 0 {
+			cs = append(cs, cell{v: v, tgt: defaultTarget})
+			continue
+		}
+		for _, t := range targetList {
+			cs = append(cs, cell{v: v, tgt: t})
+		}
+	}
+	return cs
+}
+
 // emitCleanScript emits a script 'fn' to perform a clean operation
-// prior to rebuilding/relinking kubelet.
-func emitCleanScript(fn string) {
+// prior to rebuilding/relinking 'tgt'. 'workDir' is the owning cell's
+// own GOPATH/output directory (see cellState.workDir), so that
+// concurrent workers building other cells can't clean out from under
+// each other.
+func emitCleanScript(fn string, tgt *target, workDir string) {
 	outf, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		log.Fatal(err)
 	}
 	outf.WriteString("#!/bin/sh\n")
 	if !*dryrunflag {
-		fmt.Fprintf(outf, "rm -rf ./_output/local/go/bin/%s ./_output/local/bin/linux/amd64/%s\n", prog, prog)
+		fmt.Fprintf(outf, "rm -rf %s/go/bin/%s %s/bin/linux/amd64/%s\n", workDir, tgt.prog, workDir, tgt.prog)
 	}
 	outf.Close()
 }
@@ -213,143 +517,600 @@ func grabVariantHash(v variant) string {
 	return chunks[0]
 }
 
-// emitScript emits a script 'fn' to perform a rebuild/relink using
-// the goroot path specified in 'goroot'.
-func emitScript(fn string, v variant, extra string) {
+// emitScript emits a script 'fn' to perform a rebuild/relink of 'tgt'
+// using the goroot path specified in 'v'. 'workDir' is the owning
+// cell's own GOPATH/GOCACHE directory (see cellState.workDir): each
+// cell gets one, so concurrent workers building other cells never
+// share a build cache or install over each other's binaries. When
+// -profile is set and 'profDir' is non-empty the build is run under
+// the shared -toolexec wrapper (see writeToolexecScript) so
+// cmd/compile and cmd/link drop their mem/cpu profiles into it; when
+// -json-build is set and 'jsonPath' is non-empty "go build -json" is
+// added and its event stream redirected there instead
+// of being mixed into the script's own stdout.
+func emitScript(fn string, v variant, tgt *target, extra, profDir, jsonPath, workDir string) {
 	goroot := v.goroot
 	outf, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		log.Fatal(err)
 	}
 	outf.WriteString("#!/bin/sh\n")
-	outf.WriteString("HERE=`pwd`\n")
 	outf.WriteString("WARMUP=\"$1\"\n")
 	outf.WriteString("if [ \"$WARMUP\" = \"warmup\" ]; then\n")
 	outf.WriteString("  shift\n")
 	outf.WriteString("fi\n")
 	outf.WriteString("export INJECT=\"$*\"\n")
-	outf.WriteString("export GOCACHE=$HERE/_output/local/go/cache\n")
-	outf.WriteString("export GOPATH=$HERE/_output/local/go\n")
+	fmt.Fprintf(outf, "export GOCACHE=%s/go/cache\n", workDir)
+	fmt.Fprintf(outf, "export GOPATH=%s/go\n", workDir)
 	fmt.Fprintf(outf, "export PATH=\"%s/bin:${PATH}\"\n", goroot)
 	plp := ""
 	if *perflockflag {
 		plp = "perflock "
 	}
 	if !*dryrunflag {
+		if tgt.prebuild != "" {
+			fmt.Fprintf(outf, "%s\n", tgt.prebuild)
+		}
 		if !*buildflag {
 			outf.WriteString("if [ \"$WARMUP\" = \"warmup\" ]; then\n")
-			fmt.Fprintf(outf, "  go install -i %s\n", progpath)
+			fmt.Fprintf(outf, "  go install -i %s\n", tgt.path)
 			outf.WriteString("fi\n")
 		}
-		fmt.Fprintf(outf, "rm -f /tmp/%s.%s\n", prog, v.tag)
+		fmt.Fprintf(outf, "rm -f /tmp/%s.%s\n", tgt.prog, v.tag)
 		if *buildflag {
 			fmt.Fprintf(outf, "go clean -cache\n")
 		}
-		fmt.Fprintf(outf, "%sgo build -o /tmp/%s.%s %s %s\n", plp, prog, v.tag, extra, progpath)
+		buildFlags := extra
+		if (*profileflag || *jsonbuildflag) && profDir != "" {
+			fmt.Fprintf(outf, "mkdir -p %s\n", profDir)
+		}
+		if *profileflag && profDir != "" {
+			fmt.Fprintf(outf, "export TV_PROFDIR=%s\n", profDir)
+			buildFlags = strings.TrimSpace(buildFlags + fmt.Sprintf(" -toolexec %s", toolexecPath))
+		}
+		redirect := ""
+		if *jsonbuildflag && jsonPath != "" {
+			buildFlags = strings.TrimSpace(buildFlags + " -json")
+			redirect = fmt.Sprintf(" >%s", jsonPath)
+		}
+		fmt.Fprintf(outf, "%sgo build -o /tmp/%s.%s %s %s%s\n", plp, tgt.prog, v.tag, buildFlags, tgt.path, redirect)
 	}
 	outf.Close()
 }
 
-func doVariant(script string, cleanScript string, v variant, tag string) {
+// toolexecPath is the path to the shared -toolexec wrapper script
+// used when -profile is set; populated once by writeToolexecScript
+// before any worker starts.
+var toolexecPath string
 
-	// Emit rebuild/relink script
-	emitScript(script, v, "")
+const toolexecScriptBody = `#!/bin/sh
+# Wraps cmd/compile and cmd/link invocations with -memprofile/-cpuprofile
+# writing into $TV_PROFDIR, leaving every other tool untouched. A build
+# (as opposed to a relink) invokes cmd/compile once per package in the
+# dependency graph, so the compile profiles are named after the
+# package passed via "-p" (for readability) plus this invocation's own
+# pid (for uniqueness -- two distinct import paths can sanitize to the
+# same string, and cmd/compile is a fresh process per package so $$
+# always differs between them) instead of a fixed filename; otherwise
+# each package's compile would clobber another's profile on disk.
+tool="$1"
+shift
+base=$(basename "$tool")
+case "$base" in
+  link)
+    exec "$tool" "$@" -memprofile="$TV_PROFDIR/link.memprofile" -cpuprofile="$TV_PROFDIR/link.cpuprofile"
+    ;;
+  compile)
+    pkg="unknown"
+    prev=""
+    for a in "$@"; do
+      if [ "$prev" = "-p" ]; then
+        pkg="$a"
+        break
+      fi
+      prev="$a"
+    done
+    safepkg=$(printf '%s' "$pkg" | tr -c 'A-Za-z0-9_.-' '_')
+    exec "$tool" "$@" -memprofile="$TV_PROFDIR/compile.$safepkg.$$.memprofile" -cpuprofile="$TV_PROFDIR/compile.$safepkg.$$.cpuprofile"
+    ;;
+  *)
+    exec "$tool" "$@"
+    ;;
+esac
+`
 
-	// Open output file
-	hash := grabVariantHash(v)
-	fn := fmt.Sprintf("out.%s.%s.txt", v.tag, hash)
-	var outf *os.File
-	if !*dryrunflag {
-		var err error
-		outf, err = os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-		if err != nil {
-			log.Fatal(err)
+// writeToolexecScript emits the shared -toolexec wrapper used by
+// every worker/cell when -profile is set.
+func writeToolexecScript() string {
+	f, err := ioutil.TempFile("", "toolexec")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := f.WriteString(toolexecScriptBody); err != nil {
+		log.Fatal(err)
+	}
+	f.Close()
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		log.Fatal(err)
+	}
+	return f.Name()
+}
+
+// profDirFor returns the per-iteration directory that profiling
+// artifacts (and, if requested, the "go build -json" event stream)
+// for this (cell, kind, iteration) are written to.
+func profDirFor(v variant, tgt *target, kind jobKind, iter int) string {
+	return filepath.Join("prof", fmt.Sprintf("%s.%s", v.tag, tgt.name), kind.String(), fmt.Sprintf("%05d", iter))
+}
+
+// parseBuildJSON reads the "go build -json" event stream written to
+// 'path' and returns, for each ImportPath seen, the span between its
+// first and last event as a rough approximation of the time spent on
+// that package. Returns nil if the file can't be read or parsed.
+func parseBuildJSON(path string) map[string]int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	first := map[string]time.Time{}
+	last := map[string]time.Time{}
+	var order []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
 		}
-	} else {
-		fmt.Fprintf(os.Stderr, "dryrun: open %s for output\n", fn)
-		outf = os.Stderr
+		var ev struct {
+			ImportPath string
+			Time       time.Time
+		}
+		if err := json.Unmarshal(line, &ev); err != nil || ev.ImportPath == "" {
+			continue
+		}
+		if _, ok := first[ev.ImportPath]; !ok {
+			first[ev.ImportPath] = ev.Time
+			order = append(order, ev.ImportPath)
+		}
+		last[ev.ImportPath] = ev.Time
+	}
+	if len(order) == 0 {
+		return nil
 	}
+	durations := make(map[string]int64, len(order))
+	for _, p := range order {
+		durations[p] = last[p].Sub(first[p]).Nanoseconds()
+	}
+	return durations
+}
 
-	if *verbflag {
-		fmt.Fprintf(os.Stderr, "... performing clean and/or warmup runs for variant %s\n", v.tag)
+// writeProfileLines emits one auxiliary benchstat-compatible line per
+// package durations computed by parseBuildJSON, attributing the
+// target's own import path to "/link" (its final build action is the
+// link step) and every other package to "/compile/<pkgpath>".
+func writeProfileLines(cs *cellState, tgt *target, tag string, durations map[string]int64) {
+	base := benchTag(tgt, tag)
+	cs.writeMu.Lock()
+	defer cs.writeMu.Unlock()
+	for pkg, ns := range durations {
+		name := base + "/compile/" + pkg
+		if pkg == tgt.path {
+			name = base + "/link"
+		}
+		fmt.Fprintf(cs.outf, "%s 1 %d ns/op\n", name, ns)
 	}
+}
 
-	// Extra "go build" args.
-	args := strings.Fields(v.extras)
+// jobKind distinguishes the two flavors of timed run: the main
+// (debug-enabled) build and the tgt.ldflags ("-x") nodebug build.
+type jobKind int
 
-	// First a couple of runs without timing to build dependencies, etc.
-	if o, e := exec.Command(sh, cleanScript).CombinedOutput(); e != nil {
-		fmt.Fprintf(os.Stderr, "initial clean for %s failed: %s\n", v.tag, string(o))
-		log.Fatal(e)
+const (
+	jobTimed jobKind = iota
+	jobNodebug
+)
+
+func (k jobKind) String() string {
+	if k == jobNodebug {
+		return "nodebug"
+	}
+	return "timed"
+}
+
+// job describes a single unit of work for the worker pool: iteration
+// 'iter' of kind 'kind' for the cell at index 'cidx' in 'cells'.
+type job struct {
+	cidx int
+	iter int
+	kind jobKind
+}
+
+// shardOf computes the FNV-1a hash of the (variant, target,
+// iteration, kind) tuple identifying 'j', used to decide which shard
+// it belongs to.
+func shardOf(j job) uint32 {
+	h := fnv.New32a()
+	c := cells[j.cidx]
+	fmt.Fprintf(h, "%s:%s:%d:%s", c.v.tag, c.tgt.name, j.iter, j.kind)
+	return h.Sum32()
+}
+
+// buildJobs enumerates every (cell, iteration, kind) tuple that needs
+// to be run, then filters it down to the subset assigned to this
+// process's shard. In adaptive (-ci) mode the number of samples per
+// cell isn't known up front, so each cell/kind gets a single job that
+// internally loops until the CI target is met.
+func buildJobs() []job {
+	var jobs []job
+	adaptive := *ciflag > 0
+	for cidx := range cells {
+		if adaptive {
+			jobs = append(jobs, job{cidx: cidx, kind: jobTimed})
+			if *nodebugflag {
+				jobs = append(jobs, job{cidx: cidx, kind: jobNodebug})
+			}
+			continue
+		}
+		for i := 0; i < *numitflag; i++ {
+			jobs = append(jobs, job{cidx: cidx, iter: i, kind: jobTimed})
+		}
+		if *nodebugflag {
+			for i := 0; i < *numitflag; i++ {
+				jobs = append(jobs, job{cidx: cidx, iter: i, kind: jobNodebug})
+			}
+		}
+	}
+	if *shardsflag <= 1 {
+		return jobs
+	}
+	shards := uint32(*shardsflag)
+	shard := uint32(*shardflag)
+	filtered := jobs[:0]
+	for _, j := range jobs {
+		if shardOf(j)%shards == shard {
+			filtered = append(filtered, j)
+		}
 	}
-	if !*buildflag {
-		wargs := append([]string{script, "warmup"}, args...)
-		if o, e := exec.Command(sh, wargs...).CombinedOutput(); e != nil {
-			fmt.Fprintf(os.Stderr, "initial %s for %s failed: %s\n",
-				tag, v.tag, string(o))
+	return filtered
+}
+
+// cellState holds the state shared by every worker goroutine touching
+// a given (variant, target) cell: its output file (plus a mutex to
+// serialize writes to it from concurrent workers), a sync.Once to
+// ensure the cell's one-time clean/warmup setup runs exactly once, its
+// own GOPATH/GOCACHE/output directory (workDir) so that other cells'
+// workers never share a build cache or clean/install paths with it,
+// and a mutex (jobMu) serializing the clean+build+timing body of each
+// of this cell's jobs, since the job queue hands out iterations (and
+// the timed/nodebug job pair) for the same cell to whichever worker is
+// free and workDir isn't safe for two of them to use concurrently.
+type cellState struct {
+	v         variant
+	tgt       *target
+	outf      *os.File
+	writeMu   sync.Mutex
+	setupOnce sync.Once
+	workDir   string
+	jobMu     sync.Mutex
+}
+
+func newCellState(c cell) *cellState {
+	workDir, err := ioutil.TempDir("", "tvcell")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &cellState{v: c.v, tgt: c.tgt, workDir: workDir}
+}
+
+// ensureSetup performs the cell's one-time clean-and-warmup sequence
+// using 'script' and 'cleanScript'
+// from whichever worker happens to reach it first. It also opens the
+// cell's output file. Runs at most once per cell, regardless of how
+// many workers call it.
+func (cs *cellState) ensureSetup(script, cleanScript, tag string) {
+	cs.setupOnce.Do(func() {
+		v, tgt := cs.v, cs.tgt
+
+		emitScript(script, v, tgt, "", "", "", cs.workDir)
+
+		hash := grabVariantHash(v)
+		fn := fmt.Sprintf("out.%s.%s.%s.txt", v.tag, strings.ToLower(tgt.name), hash)
+		if !*dryrunflag {
+			outf, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cs.outf = outf
+		} else {
+			fmt.Fprintf(os.Stderr, "dryrun: open %s for output\n", fn)
+			cs.outf = os.Stderr
+		}
+
+		if *verbflag {
+			fmt.Fprintf(os.Stderr, "... performing clean and/or warmup runs for variant %s target %s\n", v.tag, tgt.name)
+		}
+
+		args := strings.Fields(v.extras)
+
+		// First a couple of runs without timing to build dependencies, etc.
+		if o, e := exec.Command(sh, cleanScript).CombinedOutput(); e != nil {
+			fmt.Fprintf(os.Stderr, "initial clean for %s/%s failed: %s\n", v.tag, tgt.name, string(o))
 			log.Fatal(e)
 		}
+		if !*buildflag {
+			wargs := append([]string{script, "warmup"}, args...)
+			if o, e := exec.Command(sh, wargs...).CombinedOutput(); e != nil {
+				fmt.Fprintf(os.Stderr, "initial %s for %s/%s failed: %s\n",
+					tag, v.tag, tgt.name, string(o))
+				log.Fatal(e)
+			}
+		}
+		sargs := append([]string{script}, args...)
+		if *verbflag {
+			fmt.Fprintf(os.Stderr, "... exe.Command args: %+v\n", sargs)
+		}
+		if o, e := exec.Command(sh, sargs...).CombinedOutput(); e != nil {
+			fmt.Fprintf(os.Stderr, "initial %s for %s/%s failed: %s\n",
+				tag, v.tag, tgt.name, string(o))
+			log.Fatal(e)
+		}
+	})
+}
+
+// timedMu is held for the duration of each timed run (but not
+// warmups or cleans) when -serialize-timed is set, so that wall-clock
+// link/build measurements from concurrent workers don't overlap.
+var timedMu sync.Mutex
+
+func benchTag(tgt *target, tag string) string {
+	return "Benchmark" + titleCase(tgt.name) + titleCase(tag)
+}
+
+// runTimedJob performs one iteration of the main (debug-enabled)
+// timing loop for cell 'cs'.
+func runTimedJob(cs *cellState, script, cleanScript, tag string, iter int) {
+	cs.jobMu.Lock()
+	defer cs.jobMu.Unlock()
+	v, tgt := cs.v, cs.tgt
+	profDir := profDirFor(v, tgt, jobTimed, iter)
+	jsonPath := filepath.Join(profDir, "build.json")
+	emitScript(script, v, tgt, "", profDir, jsonPath, cs.workDir)
+	if *verbflag {
+		fmt.Fprintf(os.Stderr, "... timing run %d for variant %s target %s\n", iter, v.tag, tgt.name)
+	}
+	if _, e := exec.Command(sh, cleanScript).CombinedOutput(); e != nil {
+		log.Fatal(e)
 	}
+	args := strings.Fields(v.extras)
 	sargs := append([]string{script}, args...)
+	cmd := exec.Command(sh, sargs...)
+	if v.gomaxp != 0 {
+		cmd.Env = addGoMaxProcsEnv(cmd.Env, v.gomaxp)
+	}
 	if *verbflag {
-		fmt.Fprintf(os.Stderr, "... exe.Command args: %+v\n", sargs)
+		fmt.Fprintf(os.Stderr, "... kicking off timing run %s %+v\n", sh, sargs)
+	}
+	if *serializetimedflag {
+		timedMu.Lock()
+		defer timedMu.Unlock()
+	}
+	if _, err := runCmd(benchTag(tgt, tag), cmd, cs.outf, &cs.writeMu); err != nil {
+		log.Fatal(err)
+	}
+	if *jsonbuildflag {
+		writeProfileLines(cs, tgt, tag, parseBuildJSON(jsonPath))
 	}
-	if o, e := exec.Command(sh, sargs...).CombinedOutput(); e != nil {
-		fmt.Fprintf(os.Stderr, "initial %s for %s failed: %s\n",
-			tag, v.tag, string(o))
+}
+
+// runNodebugJob performs one iteration of the second (tgt.ldflags,
+// typically '-s -w') timing loop for cell 'cs'.
+func runNodebugJob(cs *cellState, script, cleanScript, tag string, iter int) {
+	cs.jobMu.Lock()
+	defer cs.jobMu.Unlock()
+	v, tgt := cs.v, cs.tgt
+	profDir := profDirFor(v, tgt, jobNodebug, iter)
+	jsonPath := filepath.Join(profDir, "build.json")
+	emitScript(script, v, tgt, fmt.Sprintf("-ldflags=%q", tgt.ldflags), profDir, jsonPath, cs.workDir)
+	if *verbflag {
+		fmt.Fprintf(os.Stderr, "... timing run %d for nodebug variant %s target %s\n", iter, v.tag, tgt.name)
+	}
+	if _, e := exec.Command(sh, cleanScript).CombinedOutput(); e != nil {
 		log.Fatal(e)
 	}
+	cmd := exec.Command(sh, script)
+	if v.gomaxp != 0 {
+		cmd.Env = addGoMaxProcsEnv(cmd.Env, v.gomaxp)
+	}
+	if *serializetimedflag {
+		timedMu.Lock()
+		defer timedMu.Unlock()
+	}
+	if _, err := runCmd(benchTag(tgt, tag)+"-WithoutDebug", cmd, cs.outf, &cs.writeMu); err != nil {
+		log.Fatal(err)
+	}
+	if *jsonbuildflag {
+		writeProfileLines(cs, tgt, tag+"-WithoutDebug", parseBuildJSON(jsonPath))
+	}
+}
+
+// tTable975 holds the two-sided 97.5th-percentile Student's t value
+// (i.e. t_{0.975,df}) indexed by degrees of freedom 1..30, used to
+// compute a 95% confidence interval half-width for small sample
+// counts; see tValue975.
+var tTable975 = [...]float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// tValue975 returns t_{0.975,df}, falling back to a linear
+// interpolation between df=30 and df=60 and then to the normal
+// approximation (1.96) above df=60.
+func tValue975(df int) float64 {
+	if df < 1 {
+		df = 1
+	}
+	if df <= len(tTable975) {
+		return tTable975[df-1]
+	}
+	if df <= 60 {
+		return tTable975[len(tTable975)-1] - 0.0014*float64(df-len(tTable975))
+	}
+	return 1.96
+}
+
+// meanStddev returns the sample mean and sample standard deviation of
+// 'xs'.
+func meanStddev(xs []float64) (mean, sd float64) {
+	n := float64(len(xs))
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	mean = sum / n
+	if len(xs) < 2 {
+		return mean, 0
+	}
+	var ss float64
+	for _, x := range xs {
+		d := x - mean
+		ss += d * d
+	}
+	return mean, math.Sqrt(ss / (n - 1))
+}
 
-	// Now the timing loop
-	uptag := strings.ToUpper(string(tag[0])) + tag[1:]
-	bentag := "Benchmark" + uptag + "Kubelet"
-	for i := 0; i < *numitflag; i++ {
+// ciHalfwidth returns the relative (i.e. divided by the mean) 95%
+// confidence interval half-width for the samples taken so far.
+func ciHalfwidth(samples []float64) (relative, mean float64) {
+	mean, sd := meanStddev(samples)
+	hw := tValue975(len(samples)-1) * sd / math.Sqrt(float64(len(samples)))
+	if mean == 0 {
+		return 0, mean
+	}
+	return hw / mean, mean
+}
+
+// runAdaptiveTimedJob repeatedly times the main (debug-enabled) build
+// for cell 'cs', emitting one Benchmark line per sample, until the
+// relative 95% CI on the mean drops to *ciflag or *maxnflag samples
+// have been taken.
+func runAdaptiveTimedJob(cs *cellState, script, cleanScript, tag string) {
+	cs.jobMu.Lock()
+	defer cs.jobMu.Unlock()
+	v, tgt := cs.v, cs.tgt
+	bentag := benchTag(tgt, tag)
+	needsPerIter := *profileflag || *jsonbuildflag
+	if !needsPerIter {
+		emitScript(script, v, tgt, "", "", "", cs.workDir)
+	}
+	var samples []float64
+	for len(samples) < *maxnflag {
+		iter := len(samples)
+		var jsonPath string
+		if needsPerIter {
+			profDir := profDirFor(v, tgt, jobTimed, iter)
+			jsonPath = filepath.Join(profDir, "build.json")
+			emitScript(script, v, tgt, "", profDir, jsonPath, cs.workDir)
+		}
 		if *verbflag {
-			fmt.Fprintf(os.Stderr, "... timing run %d for variant %s\n", i, v.tag)
+			fmt.Fprintf(os.Stderr, "... adaptive timing run %d for variant %s target %s\n", iter, v.tag, tgt.name)
 		}
-		// clean
 		if _, e := exec.Command(sh, cleanScript).CombinedOutput(); e != nil {
 			log.Fatal(e)
 		}
-		// time
+		args := strings.Fields(v.extras)
+		sargs := append([]string{script}, args...)
 		cmd := exec.Command(sh, sargs...)
 		if v.gomaxp != 0 {
 			cmd.Env = addGoMaxProcsEnv(cmd.Env, v.gomaxp)
 		}
-		if *verbflag {
-			fmt.Fprintf(os.Stderr, "... kicking off timing run %s %+v\n",
-				sh, sargs)
+		if *serializetimedflag {
+			timedMu.Lock()
 		}
-		if err := runCmd(bentag, cmd, outf); err != nil {
+		ns, err := runCmd(bentag, cmd, cs.outf, &cs.writeMu)
+		if *serializetimedflag {
+			timedMu.Unlock()
+		}
+		if err != nil {
 			log.Fatal(err)
 		}
-	}
-
-	// Second loop for -s -w if enabled.
-	if *nodebugflag {
-		emitScript(script, v, "-ldflags=\"-s -w\"")
-		for i := 0; i < *numitflag; i++ {
-			if *verbflag {
-				fmt.Fprintf(os.Stderr, "... timing run %d for nodebug variant %s\n", i, v.tag)
-			}
-			// clean
-			if _, e := exec.Command(sh, cleanScript).CombinedOutput(); e != nil {
-				log.Fatal(e)
-			}
-			// time
-			cmd := exec.Command(sh, script)
-			if v.gomaxp != 0 {
-				cmd.Env = addGoMaxProcsEnv(cmd.Env, v.gomaxp)
-			}
-			if err := runCmd(bentag+"-WithoutDebug", cmd, outf); err != nil {
-				log.Fatal(err)
+		if *jsonbuildflag {
+			writeProfileLines(cs, tgt, tag, parseBuildJSON(jsonPath))
+		}
+		samples = append(samples, float64(ns))
+		if len(samples) >= *minnflag {
+			rel, _ := ciHalfwidth(samples)
+			if rel <= *ciflag {
+				fmt.Fprintf(os.Stderr, "variant %s target %s: reached target CI %.4f (achieved %.4f) after n=%d\n",
+					v.tag, tgt.name, *ciflag, rel, len(samples))
+				return
 			}
 		}
 	}
+	rel, _ := ciHalfwidth(samples)
+	fmt.Fprintf(os.Stderr, "variant %s target %s: hit -max-n=%d before reaching target CI %.4f (achieved %.4f)\n",
+		v.tag, tgt.name, *maxnflag, *ciflag, rel)
+}
 
-	if !*dryrunflag {
-		outf.Close()
+// runAdaptiveNodebugJob is the tgt.ldflags counterpart of
+// runAdaptiveTimedJob.
+func runAdaptiveNodebugJob(cs *cellState, script, cleanScript, tag string) {
+	cs.jobMu.Lock()
+	defer cs.jobMu.Unlock()
+	v, tgt := cs.v, cs.tgt
+	bentag := benchTag(tgt, tag) + "-WithoutDebug"
+	needsPerIter := *profileflag || *jsonbuildflag
+	if !needsPerIter {
+		emitScript(script, v, tgt, fmt.Sprintf("-ldflags=%q", tgt.ldflags), "", "", cs.workDir)
 	}
+	var samples []float64
+	for len(samples) < *maxnflag {
+		iter := len(samples)
+		var jsonPath string
+		if needsPerIter {
+			profDir := profDirFor(v, tgt, jobNodebug, iter)
+			jsonPath = filepath.Join(profDir, "build.json")
+			emitScript(script, v, tgt, fmt.Sprintf("-ldflags=%q", tgt.ldflags), profDir, jsonPath, cs.workDir)
+		}
+		if *verbflag {
+			fmt.Fprintf(os.Stderr, "... adaptive nodebug timing run %d for variant %s target %s\n", iter, v.tag, tgt.name)
+		}
+		if _, e := exec.Command(sh, cleanScript).CombinedOutput(); e != nil {
+			log.Fatal(e)
+		}
+		cmd := exec.Command(sh, script)
+		if v.gomaxp != 0 {
+			cmd.Env = addGoMaxProcsEnv(cmd.Env, v.gomaxp)
+		}
+		if *serializetimedflag {
+			timedMu.Lock()
+		}
+		ns, err := runCmd(bentag, cmd, cs.outf, &cs.writeMu)
+		if *serializetimedflag {
+			timedMu.Unlock()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *jsonbuildflag {
+			writeProfileLines(cs, tgt, tag+"-WithoutDebug", parseBuildJSON(jsonPath))
+		}
+		samples = append(samples, float64(ns))
+		if len(samples) >= *minnflag {
+			rel, _ := ciHalfwidth(samples)
+			if rel <= *ciflag {
+				fmt.Fprintf(os.Stderr, "variant %s target %s: nodebug reached target CI %.4f (achieved %.4f) after n=%d\n",
+					v.tag, tgt.name, *ciflag, rel, len(samples))
+				return
+			}
+		}
+	}
+	rel, _ := ciHalfwidth(samples)
+	fmt.Fprintf(os.Stderr, "variant %s target %s: nodebug hit -max-n=%d before reaching target CI %.4f (achieved %.4f)\n",
+		v.tag, tgt.name, *maxnflag, *ciflag, rel)
 }
 
 func addGoMaxProcsEnv(env []string, gomaxp int) []string {
@@ -367,9 +1128,11 @@ func addGoMaxProcsEnv(env []string, gomaxp int) []string {
 	return rv
 }
 
-func perform() {
-	// emit clean script
-	cleanScript, cerr := ioutil.TempFile("", "clean")
+// worker pulls jobs off 'jobs' until the channel is closed, running
+// each against its own pair of clean/build scripts so that concurrent
+// workers never write over each other's scripts.
+func worker(id int, jobs <-chan job, cstates []*cellState, tag string) {
+	cleanScript, cerr := ioutil.TempFile("", fmt.Sprintf("clean%d", id))
 	if cerr != nil {
 		log.Fatal(cerr)
 	}
@@ -378,14 +1141,8 @@ func perform() {
 	} else {
 		fmt.Fprintf(os.Stderr, "... preserving clean script %s\n", cleanScript.Name())
 	}
-	emitCleanScript(cleanScript.Name())
 
-	// emit build/link script
-	tag := "relink"
-	if *buildflag {
-		tag = "rebuild"
-	}
-	script, rerr := ioutil.TempFile("", tag)
+	script, rerr := ioutil.TempFile("", fmt.Sprintf("%s%d", tag, id))
 	if rerr != nil {
 		log.Fatal(rerr)
 	}
@@ -395,12 +1152,119 @@ func perform() {
 		fmt.Fprintf(os.Stderr, "... preserving %s script %s\n", tag, script.Name())
 	}
 
-	// loop over variants
-	for _, v := range variants {
+	for j := range jobs {
+		cs := cstates[j.cidx]
 		if *verbflag {
-			fmt.Fprintf(os.Stderr, "... starting variant: %+v\n", v)
+			fmt.Fprintf(os.Stderr, "... worker %d starting variant=%s target=%s iter=%d kind=%s\n",
+				id, cs.v.tag, cs.tgt.name, j.iter, j.kind)
+		}
+		// Scripts are target-specific (they embed tgt.prog/tgt.path/
+		// cs.workDir), so refresh the clean script for whichever cell
+		// this job targets before using it; emitScript is likewise
+		// refreshed by each run function below.
+		emitCleanScript(cleanScript.Name(), cs.tgt, cs.workDir)
+		cs.ensureSetup(script.Name(), cleanScript.Name(), tag)
+		adaptive := *ciflag > 0
+		switch {
+		case j.kind == jobTimed && adaptive:
+			runAdaptiveTimedJob(cs, script.Name(), cleanScript.Name(), tag)
+		case j.kind == jobTimed:
+			runTimedJob(cs, script.Name(), cleanScript.Name(), tag, j.iter)
+		case j.kind == jobNodebug && adaptive:
+			runAdaptiveNodebugJob(cs, script.Name(), cleanScript.Name(), tag)
+		case j.kind == jobNodebug:
+			runNodebugJob(cs, script.Name(), cleanScript.Name(), tag, j.iter)
 		}
-		doVariant(script.Name(), cleanScript.Name(), v, tag)
+	}
+}
+
+func perform() {
+	tag := "relink"
+	if *buildflag {
+		tag = "rebuild"
+	}
+
+	if *profileflag {
+		toolexecPath = writeToolexecScript()
+		if !*preservetmpsflag {
+			defer os.Remove(toolexecPath)
+		}
+	}
+
+	cells = buildCells()
+	cstates := make([]*cellState, len(cells))
+	for i, c := range cells {
+		cstates[i] = newCellState(c)
+		if !*preservetmpsflag {
+			defer os.RemoveAll(cstates[i].workDir)
+		} else {
+			fmt.Fprintf(os.Stderr, "... preserving work dir %s\n", cstates[i].workDir)
+		}
+	}
+
+	jobs := buildJobs()
+	if len(jobs) == 0 {
+		fmt.Fprintf(os.Stderr, "warning: no runs assigned to shard %d of %d\n", *shardflag, *shardsflag)
+		return
+	}
+
+	nworkers := *parflag
+	if nworkers < 1 {
+		nworkers = 1
+	}
+	if nworkers > len(jobs) {
+		nworkers = len(jobs)
+	}
+
+	jobCh := make(chan job)
+	var wg sync.WaitGroup
+	for w := 0; w < nworkers; w++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			worker(id, jobCh, cstates, tag)
+		}(w)
+	}
+	for _, j := range jobs {
+		jobCh <- j
+	}
+	close(jobCh)
+	wg.Wait()
+
+	if !*dryrunflag {
+		for _, cs := range cstates {
+			if cs.outf != nil {
+				cs.outf.Close()
+			}
+		}
+	}
+
+	if *profileflag {
+		printProfileSummary(cells)
+	}
+}
+
+// printProfileSummary runs 'go tool pprof -top' over the most recent
+// linker memprofile collected for each cell's timed runs and copies
+// pprof's output to stderr unchanged. No peak-RSS figure is computed,
+// and nodebug-run profiles are not summarized.
+func printProfileSummary(cells []cell) {
+	fmt.Fprintf(os.Stderr, "\n=== linker memprofile summary (go tool pprof -top) ===\n")
+	for _, c := range cells {
+		pattern := filepath.Join("prof", fmt.Sprintf("%s.%s", c.v.tag, c.tgt.name), jobTimed.String(), "*", "link.memprofile")
+		matches, _ := filepath.Glob(pattern)
+		if len(matches) == 0 {
+			continue
+		}
+		prof := matches[len(matches)-1]
+		gocmd := fmt.Sprintf("%s/bin/go", c.v.goroot)
+		out, err := exec.Command(gocmd, "tool", "pprof", "-top", prof).CombinedOutput()
+		fmt.Fprintf(os.Stderr, "--- variant=%s target=%s profile=%s ---\n", c.v.tag, c.tgt.name, prof)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "(pprof failed: %v)\n", err)
+			continue
+		}
+		os.Stderr.Write(out)
 	}
 }
 
@@ -408,6 +1272,16 @@ func main() {
 	log.SetFlags(0)
 	log.SetPrefix("timevariants: ")
 	flag.Parse()
+	if *shardflag < 0 || *shardsflag < 1 || *shardflag >= *shardsflag {
+		usage(fmt.Sprintf("invalid -shard/-shards combination: shard=%d shards=%d", *shardflag, *shardsflag))
+	}
+	if *ciflag < 0 {
+		usage(fmt.Sprintf("invalid -ci value: %f", *ciflag))
+	}
+	if *ciflag > 0 && *minnflag < 2 {
+		usage(fmt.Sprintf("-min-n must be at least 2 when -ci is set, got %d", *minnflag))
+	}
+	readtargets()
 	readvariants()
 	perform()
 }